@@ -0,0 +1,137 @@
+// Package admin is a small supervisor API for the child processes runsm
+// manages (caddy, the PHP worker(s), ebcfetch). It replaces fire-and-forget
+// cmd.Start() calls with something an operator can actually inspect:
+//
+//	GET  /procs                 - pid/uptime/restarts/last-exit for every process
+//	GET  /procs/{name}          - the same, for one process
+//	POST /procs/{name}/start
+//	POST /procs/{name}/stop
+//	POST /procs/{name}/restart
+//	GET  /procs/{name}/log      - WebSocket, tails that process's captured output
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event is one line of captured stdout/stderr from a managed process.
+type Event struct {
+	Time time.Time
+	Line string
+}
+
+// State is a snapshot of a managed process, as returned by GET /procs.
+type State struct {
+	Name     string    `json:"name"`
+	Pid      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Restarts int       `json:"restarts"`
+	Running  bool      `json:"running"`
+	LastExit string    `json:"lastExit,omitempty"`
+}
+
+// Process is anything runsm supervises. Implementations live in the main
+// package, wrapping the existing runCaddy/runPHP/runEBCFetch mechanics.
+type Process interface {
+	Name() string
+	State() State
+	Start() error
+	Stop() error
+	Restart() error
+	Wait() error
+	Events() <-chan Event
+	Unsubscribe(<-chan Event)
+}
+
+// Server serves the admin HTTP API over procs.
+type Server struct {
+	addr  string
+	procs map[string]Process
+}
+
+// NewServer builds a Server exposing the given processes, keyed by Name().
+func NewServer(addr string, procs ...Process) *Server {
+	m := make(map[string]Process, len(procs))
+	for _, p := range procs {
+		m[p.Name()] = p
+	}
+	return &Server{addr: addr, procs: m}
+}
+
+// ListenAndServe blocks, serving the admin API on s.addr. It's meant to be
+// run in its own goroutine, bound to 127.0.0.1 so it's never reachable off
+// the box running runsm.
+func (s *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/procs", s.handleList)
+	mux.HandleFunc("/procs/", s.handleProc)
+	return http.ListenAndServe(s.addr, mux)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	states := make([]State, 0, len(s.procs))
+	for _, p := range s.procs {
+		states = append(states, p.State())
+	}
+	json.NewEncoder(w).Encode(states)
+}
+
+func (s *Server) handleProc(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/procs/")
+	name, action, _ := strings.Cut(rest, "/")
+
+	p, ok := s.procs[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "":
+		json.NewEncoder(w).Encode(p.State())
+	case "start":
+		s.doAction(w, r, p.Start)
+	case "stop":
+		s.doAction(w, r, p.Stop)
+	case "restart":
+		s.doAction(w, r, p.Restart)
+	case "log":
+		s.tailLog(w, r, p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) doAction(w http.ResponseWriter, r *http.Request, fn func() error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := fn(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) tailLog(w http.ResponseWriter, r *http.Request, p Process) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	events := p.Events()
+	defer p.Unsubscribe(events)
+
+	for ev := range events {
+		line := ev.Time.Format("2006-01-02 15:04:05") + " " + ev.Line
+		if err := conn.writeText(line); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package admin
+
+/*
+ * A minimal RFC 6455 WebSocket server, just enough to push text frames down
+ * /procs/{name}/log. We never need to read frames back from the browser, so
+ * this deliberately doesn't implement a reader, fragmentation or pings -
+ * only the handshake and unmasked text/close frame writes.
+ */
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+)
+
+type wsConn struct {
+	net.Conn
+	bw *bufio.Writer
+}
+
+// upgrade performs the WebSocket handshake and hijacks the underlying TCP
+// connection for frame writes.
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("admin: not a websocket request")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("admin: connection doesn't support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	accept := acceptKey(key)
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, bw: rw.Writer}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (c *wsConn) writeText(msg string) error {
+	return c.writeFrame(opText, []byte(msg))
+}
+
+// writeFrame writes an unmasked frame, which is all a server is ever
+// allowed to send per section 5.1 of the spec.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode} // FIN + opcode, no fragmentation
+
+	l := len(payload)
+	switch {
+	case l <= 125:
+		header = append(header, byte(l))
+	case l <= 65535:
+		header = append(header, 126, byte(l>>8), byte(l))
+	default:
+		header = append(header, 127,
+			byte(l>>56), byte(l>>48), byte(l>>40), byte(l>>32),
+			byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+
+	if _, err := c.bw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write(payload); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
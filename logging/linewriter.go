@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// LineSplitter buffers arbitrary writes (as come from a child process's
+// stdout/stderr pipe) across calls and invokes OnLine once per complete
+// line, dropping the trailing newline (and any carriage return); blank
+// lines are skipped. It exists so anything else that
+// needs to turn chunked writes into whole lines - ringLog in the main
+// package, alongside lineWriter below - doesn't have to re-derive this
+// a second time.
+type LineSplitter struct {
+	OnLine func(line string)
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *LineSplitter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(s.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := strings.TrimRight(string(s.buf.Next(idx+1)), "\r\n")
+		if line != "" {
+			s.OnLine(line)
+		}
+	}
+	return len(p), nil
+}
+
+// lineWriter buffers arbitrary writes (as come from a child process's
+// stdout/stderr pipe) and logs one Entry per complete line.
+type lineWriter struct {
+	split LineSplitter
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	return w.split.Write(p)
+}
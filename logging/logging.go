@@ -0,0 +1,113 @@
+// Package logging replaces runsm's old "timestamp + fmt.Print" logWriter
+// with a structured logger: every entry is written as one JSON object per
+// line (ts, level, component, pid, msg) to a rotating file under
+// caddy/logs/, while a second, human-readable sink still goes to the
+// console so running runsm interactively looks the way it always has.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level string
+
+const (
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+// Entry is one structured log line.
+type Entry struct {
+	Time      time.Time `json:"ts"`
+	Level     Level     `json:"level"`
+	Component string    `json:"component"`
+	Pid       int       `json:"pid"`
+	Msg       string    `json:"msg"`
+}
+
+// Logger writes Entries to a rotating JSON file and, in parallel, a
+// human-readable line to the console in either text or json format.
+type Logger struct {
+	mu     sync.Mutex
+	file   *rotatingFile
+	format string // "text" or "json"
+	pid    int
+}
+
+// New opens (creating if needed) a rotating log file under dir and
+// returns a Logger. format is "text" or "json" and controls only the
+// console sink; the file sink is always JSON.
+func New(dir string, format string) (*Logger, error) {
+	f, err := newRotatingFile(dir, "runsm.log", 10*1024*1024, 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if format != "json" {
+		format = "text"
+	}
+	return &Logger{file: f, format: format, pid: os.Getpid()}, nil
+}
+
+// Log writes one entry to both sinks.
+func (l *Logger) Log(level Level, component, msg string) {
+	e := Entry{
+		Time:      time.Now().UTC(),
+		Level:     level,
+		Component: component,
+		Pid:       l.pid,
+		Msg:       msg,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, err := json.Marshal(e)
+	if err == nil {
+		l.file.Write(append(b, '\n'))
+	}
+
+	switch l.format {
+	case "json":
+		fmt.Println(string(b))
+	default:
+		fmt.Printf("%s %-5s %-8s %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Level, component, msg)
+	}
+}
+
+func (l *Logger) Info(component, msg string)  { l.Log(LevelInfo, component, msg) }
+func (l *Logger) Warn(component, msg string)  { l.Log(LevelWarn, component, msg) }
+func (l *Logger) Error(component, msg string) { l.Log(LevelError, component, msg) }
+
+// Capture logs one already-split line of captured child output, guessing
+// its level from common PHP/Caddy warning/error phrasing and falling
+// back to def otherwise.
+func (l *Logger) Capture(component string, def Level, line string) {
+	l.Log(guessLevel(line, def), component, line)
+}
+
+// Writer returns an io.Writer suitable for a cmd.Stdout/Stderr: it buffers
+// partial lines and logs each complete one under component via Capture,
+// so at the level guessLevel picks from the line's wording, or def.
+func (l *Logger) Writer(component string, def Level) *lineWriter {
+	w := &lineWriter{}
+	w.split.OnLine = func(line string) { l.Capture(component, def, line) }
+	return w
+}
+
+func guessLevel(line string, def Level) Level {
+	switch {
+	case strings.Contains(line, "Fatal error") || strings.Contains(line, "Error:"):
+		return LevelError
+	case strings.Contains(line, "Warning") || strings.Contains(line, "Deprecated"):
+		return LevelWarn
+	default:
+		return def
+	}
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rotatingFile is an io.Writer over a single log file that renames itself
+// out of the way and reopens once it exceeds maxSize or maxAge, so
+// caddy/logs/ doesn't grow without bound across a long-running event.
+type rotatingFile struct {
+	dir     string
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(dir, name string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rf := &rotatingFile{dir: dir, name: name, maxSize: maxSize, maxAge: maxAge}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(filepath.Join(rf.dir, rf.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	size := int64(0)
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+	rf.f = f
+	rf.size = size
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size+int64(len(p)) > rf.maxSize || time.Since(rf.opened) > rf.maxAge {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	stamp := time.Now().UTC().Format("20060102-150405")
+	base := strings.TrimSuffix(rf.name, filepath.Ext(rf.name))
+	rotated := filepath.Join(rf.dir, base+"-"+stamp+filepath.Ext(rf.name))
+	if err := os.Rename(filepath.Join(rf.dir, rf.name), rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
@@ -0,0 +1,322 @@
+package pool
+
+/*
+ * A trimmed FastCGI client, enough to front a pool of php-cgi workers.
+ *
+ * The record framing follows the FastCGI spec (section 3.3): an 8-byte
+ * header followed by content and padding. We only implement the subset
+ * needed to run a single request to completion - BEGIN_REQUEST, PARAMS,
+ * STDIN out; STDOUT/STDERR/END_REQUEST in - plus GET_VALUES for the
+ * health-check ping.
+ *
+ * This is a deliberately small port of the ideas in Caddy's
+ * reverseproxy/fastcgi/client.go, not a general purpose FastCGI library.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pingTimeout bounds how long a health-check ping waits for a worker to
+// reply; requestTimeout bounds a full request/response round trip.
+const (
+	pingTimeout    = 2 * time.Second
+	requestTimeout = 60 * time.Second
+)
+
+const (
+	fcgiVersion1 = 1
+
+	fcgiBeginRequest    = 1
+	fcgiAbortRequest    = 2
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiGetValues       = 9
+	fcgiGetValuesResult = 10
+
+	fcgiResponder = 1
+
+	fcgiKeepConn = 1
+
+	maxRecordContent = 65535
+)
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// writeRecord writes content as one or more FastCGI records, splitting it
+// into maxRecordContent-sized chunks. An empty content writes a single
+// zero-length record, which is how PARAMS and STDIN streams are
+// terminated per the spec.
+func writeRecord(w io.Writer, recType uint8, reqID uint16, content []byte) error {
+	for {
+		chunk := content
+		if len(chunk) > maxRecordContent {
+			chunk = chunk[:maxRecordContent]
+		}
+		h := fcgiHeader{
+			Version:       fcgiVersion1,
+			Type:          recType,
+			RequestID:     reqID,
+			ContentLength: uint16(len(chunk)),
+		}
+		if err := binary.Write(w, binary.BigEndian, h); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+func readHeader(r io.Reader) (fcgiHeader, error) {
+	var h fcgiHeader
+	err := binary.Read(r, binary.BigEndian, &h)
+	return h, err
+}
+
+// encodeParam appends a FastCGI name/value pair using the length-prefix
+// encoding from section 3.4 of the spec.
+func encodeParam(buf *bytes.Buffer, name, value string) {
+	encodeLen := func(l int) {
+		if l <= 127 {
+			buf.WriteByte(byte(l))
+			return
+		}
+		binary.Write(buf, binary.BigEndian, uint32(l)|1<<31)
+	}
+	encodeLen(len(name))
+	encodeLen(len(value))
+	buf.WriteString(name)
+	buf.WriteString(value)
+}
+
+// buildParams maps an http.Request onto the CGI environment php-cgi expects,
+// filling out the same standard vars Caddy's own php_fastcgi (what this
+// replaces under -workers) sets, so PHP code built against that
+// environment - e.g. absolute URLs from SERVER_NAME, HTTPS checks -
+// behaves the same under the pool.
+func buildParams(r *http.Request, docRoot, scriptName string, contentLength int64) []byte {
+	var buf bytes.Buffer
+	set := func(k, v string) { encodeParam(&buf, k, v) }
+
+	serverName := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		serverName = h
+	}
+
+	remoteAddr, remotePort := r.RemoteAddr, ""
+	if h, p, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteAddr, remotePort = h, p
+	}
+
+	serverAddr, serverPort := "", ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if h, p, err := net.SplitHostPort(addr.String()); err == nil {
+			serverAddr, serverPort = h, p
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+
+	set("SCRIPT_FILENAME", docRoot+scriptName)
+	set("SCRIPT_NAME", scriptName)
+	set("DOCUMENT_ROOT", docRoot)
+	set("REQUEST_METHOD", r.Method)
+	set("REQUEST_URI", r.URL.RequestURI())
+	set("REQUEST_SCHEME", scheme)
+	if scheme == "https" {
+		set("HTTPS", "on")
+	}
+	set("QUERY_STRING", r.URL.RawQuery)
+	set("SERVER_PROTOCOL", r.Proto)
+	set("GATEWAY_INTERFACE", "CGI/1.1")
+	set("SERVER_SOFTWARE", "runsm")
+	set("SERVER_NAME", serverName)
+	set("SERVER_ADDR", serverAddr)
+	set("SERVER_PORT", serverPort)
+	set("REMOTE_ADDR", remoteAddr)
+	set("REMOTE_PORT", remotePort)
+	set("CONTENT_TYPE", r.Header.Get("Content-Type"))
+	if contentLength >= 0 {
+		set("CONTENT_LENGTH", strconv.FormatInt(contentLength, 10))
+	}
+	for k, v := range r.Header {
+		if len(v) == 0 {
+			continue
+		}
+		set("HTTP_"+headerEnvName(k), v[0])
+	}
+	return buf.Bytes()
+}
+
+func headerEnvName(h string) string {
+	out := make([]byte, len(h))
+	for i := 0; i < len(h); i++ {
+		c := h[i]
+		if c == '-' {
+			out[i] = '_'
+		} else if c >= 'a' && c <= 'z' {
+			out[i] = c - 'a' + 'A'
+		} else {
+			out[i] = c
+		}
+	}
+	return string(out)
+}
+
+// roundTrip runs one request/response cycle over an already-dialled
+// FastCGI connection and writes the result to w.
+func roundTrip(conn net.Conn, r *http.Request, docRoot, scriptName string, w http.ResponseWriter) error {
+	const reqID = 1
+
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return err
+	}
+
+	body := io.Reader(r.Body)
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(conn)
+
+	begin := make([]byte, 8)
+	binary.BigEndian.PutUint16(begin[0:2], fcgiResponder)
+	begin[2] = fcgiKeepConn
+	if err := writeRecord(bw, fcgiBeginRequest, reqID, begin); err != nil {
+		return err
+	}
+
+	params := buildParams(r, docRoot, scriptName, int64(len(bodyBytes)))
+	if err := writeRecord(bw, fcgiParams, reqID, params); err != nil {
+		return err
+	}
+	if err := writeRecord(bw, fcgiParams, reqID, nil); err != nil {
+		return err
+	}
+	if len(bodyBytes) > 0 {
+		if err := writeRecord(bw, fcgiStdin, reqID, bodyBytes); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(bw, fcgiStdin, reqID, nil); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	br := bufio.NewReader(conn)
+	for {
+		h, err := readHeader(br)
+		if err != nil {
+			return err
+		}
+		content := make([]byte, h.ContentLength)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return err
+		}
+		if h.PaddingLength > 0 {
+			if _, err := io.CopyN(io.Discard, br, int64(h.PaddingLength)); err != nil {
+				return err
+			}
+		}
+		switch h.Type {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			return writeResponse(w, stdout.Bytes(), stderr.Bytes())
+		default:
+			// ignore anything else the worker sends us
+		}
+	}
+}
+
+// writeResponse splits the CGI-style header block from the body and
+// copies both onto the ResponseWriter.
+func writeResponse(w http.ResponseWriter, stdout, stderr []byte) error {
+	if len(stderr) > 0 {
+		fmt.Fprintf(errLog, "%s", stderr)
+	}
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(stdout)))
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	status := http.StatusOK
+	if s := mimeHeader.Get("Status"); s != "" {
+		if n, err := strconv.Atoi(s[:3]); err == nil {
+			status = n
+		}
+		mimeHeader.Del("Status")
+	}
+	for k, vs := range mimeHeader {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(status)
+	rest, _ := io.ReadAll(tp.R)
+	_, err = w.Write(rest)
+	return err
+}
+
+// pingValues sends an FCGI_GET_VALUES for FCGI_MAX_CONNS, used purely as
+// a liveness check: a worker that isn't accepting FastCGI records will
+// fail to answer before the dial/read deadline expires. The deadline is
+// set here too, not just on dial, since a worker that accepts the
+// connection but never replies would otherwise hang checkWorker forever.
+func pingValues(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(pingTimeout)); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	encodeParam(&buf, "FCGI_MAX_CONNS", "")
+	if err := writeRecord(conn, fcgiGetValues, 0, buf.Bytes()); err != nil {
+		return err
+	}
+	h, err := readHeader(conn)
+	if err != nil {
+		return err
+	}
+	if h.Type != fcgiGetValuesResult {
+		return errors.New("pool: unexpected reply to FCGI_GET_VALUES")
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(h.ContentLength)+int64(h.PaddingLength))
+	return err
+}
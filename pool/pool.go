@@ -0,0 +1,305 @@
+// Package pool manages a small fleet of php-cgi workers speaking FastCGI
+// over local sockets, in place of spawning a single php-cgi process and
+// killing it on a timer (the old execPHP/runPHP approach in runsm.go).
+//
+// Workers are pre-forked, health-checked with a periodic FCGI_GET_VALUES
+// ping, and retired individually - on a request count or age limit - so a
+// worker reaching the end of its life doesn't take in-flight uploads down
+// with it.
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errLog io.Writer = os.Stderr
+
+// SetErrorLog redirects worker stderr and pool diagnostics, which
+// otherwise go to os.Stderr.
+func SetErrorLog(w io.Writer) {
+	errLog = w
+}
+
+// Pool runs Size php-cgi workers and round-robins FastCGI requests across
+// whichever of them are currently healthy.
+type Pool struct {
+	PHPPath     string        // path to the php-cgi executable
+	DocRoot     string        // filesystem root handed to php-cgi as SCRIPT_FILENAME base
+	Size        int           // number of workers to keep running
+	MaxRequests int64         // requests a worker serves before it's retired, 0 = unlimited
+	MaxLifetime time.Duration // age at which a worker is retired, 0 = unlimited
+	SocketDir   string        // where to put unix sockets (ignored on windows)
+
+	mu      sync.Mutex
+	workers []*worker
+	next    uint32
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+type worker struct {
+	network  string
+	addr     string
+	cmd      *exec.Cmd
+	started  time.Time
+	requests int64
+	draining int32
+}
+
+// NewPool constructs a Pool. Call Start to actually fork the workers.
+func NewPool(phpPath, docRoot string, size int, maxRequests int, maxLifetime time.Duration) *Pool {
+	return &Pool{
+		PHPPath:     phpPath,
+		DocRoot:     docRoot,
+		Size:        size,
+		MaxRequests: int64(maxRequests),
+		MaxLifetime: maxLifetime,
+		SocketDir:   filepath.Join("caddy", "sockets"),
+	}
+}
+
+// Start forks Size workers and begins the background health-check loop.
+func (p *Pool) Start() error {
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if p.network() == "unix" {
+		if err := os.MkdirAll(p.SocketDir, 0700); err != nil {
+			return err
+		}
+	}
+	p.workers = make([]*worker, p.Size)
+	for i := 0; i < p.Size; i++ {
+		w, err := p.spawn(i)
+		if err != nil {
+			return fmt.Errorf("pool: spawning worker %d: %w", i, err)
+		}
+		p.workers[i] = w
+	}
+	go p.healthLoop()
+	return nil
+}
+
+// Stop kills every worker outright, without draining, since by this
+// point the caller (runsm shutting down) no longer wants to wait.
+func (p *Pool) Stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.workers {
+		if w != nil && w.cmd.Process != nil {
+			w.cmd.Process.Kill()
+		}
+	}
+}
+
+func (p *Pool) network() string {
+	if runtime.GOOS == "windows" {
+		return "tcp"
+	}
+	return "unix"
+}
+
+func (p *Pool) spawn(idx int) (*worker, error) {
+	network := p.network()
+	var addr string
+	if network == "unix" {
+		addr = filepath.Join(p.SocketDir, fmt.Sprintf("worker%d.sock", idx))
+		os.Remove(addr)
+	} else {
+		addr = fmt.Sprintf("127.0.0.1:%d", 9100+idx)
+	}
+
+	cmd := exec.Command(p.PHPPath, "-b", addr)
+	cmd.Env = append(os.Environ(), "PHP_FCGI_MAX_REQUESTS=0")
+	cmd.Stderr = taggedWriter{prefix: fmt.Sprintf("php[%d]", idx)}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	w := &worker{network: network, addr: addr, cmd: cmd, started: time.Now()}
+	if err := waitListening(network, addr, 3*time.Second); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	return w, nil
+}
+
+func waitListening(network, addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout(network, addr, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("pool: worker at %s never came up", addr)
+}
+
+// pick returns the next worker in round-robin order, skipping any
+// currently draining.
+func (p *Pool) pick() *worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.workers)
+	for i := 0; i < n; i++ {
+		idx := int(atomic.AddUint32(&p.next, 1)) % n
+		w := p.workers[idx]
+		if w != nil && atomic.LoadInt32(&w.draining) == 0 {
+			return w
+		}
+	}
+	return nil
+}
+
+// Serve forwards r to a healthy worker and, once the worker has finished
+// the request, writes its buffered response to w.
+func (p *Pool) Serve(w http.ResponseWriter, r *http.Request) {
+	wk := p.pick()
+	if wk == nil {
+		http.Error(w, "no PHP workers available", http.StatusBadGateway)
+		return
+	}
+	conn, err := net.DialTimeout(wk.network, wk.addr, 5*time.Second)
+	if err != nil {
+		http.Error(w, "PHP worker unreachable", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	scriptName := resolveScript(r.URL.Path)
+	if err := roundTrip(conn, r, p.DocRoot, scriptName, w); err != nil {
+		fmt.Fprintf(errLog, "pool: request to %s failed: %v\n", wk.addr, err)
+		http.Error(w, "PHP worker error", http.StatusBadGateway)
+		return
+	}
+	atomic.AddInt64(&wk.requests, 1)
+}
+
+// resolveScript maps a directory-style request path onto the default
+// document php-cgi should actually run, the way Caddy's own php_fastcgi
+// try_files/index handling would for a plain FastCGI backend. Caddy's
+// Caddyfile for the pool already rewrites onto a real .php file before
+// proxying here (see runCaddyLogged), but Serve resolves it too so a
+// bare "/" still runs index.php rather than handing php-cgi a directory.
+func resolveScript(path string) string {
+	if path == "" || strings.HasSuffix(path, "/") {
+		path += "index.php"
+	}
+	return path
+}
+
+// healthLoop pings each worker periodically and retires it, one at a
+// time, once it's too old, has served too many requests, or stops
+// answering FastCGI at all.
+func (p *Pool) healthLoop() {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-t.C:
+			p.mu.Lock()
+			n := len(p.workers)
+			p.mu.Unlock()
+			for i := 0; i < n; i++ {
+				p.checkWorker(i)
+			}
+		}
+	}
+}
+
+func (p *Pool) checkWorker(idx int) {
+	p.mu.Lock()
+	w := p.workers[idx]
+	p.mu.Unlock()
+	if w == nil {
+		return
+	}
+
+	tooOld := p.MaxLifetime > 0 && time.Since(w.started) > p.MaxLifetime
+	tooBusy := p.MaxRequests > 0 && atomic.LoadInt64(&w.requests) >= p.MaxRequests
+
+	alive := true
+	conn, err := net.DialTimeout(w.network, w.addr, 2*time.Second)
+	if err != nil {
+		alive = false
+	} else {
+		if err := pingValues(conn); err != nil {
+			alive = false
+		}
+		conn.Close()
+	}
+
+	if alive && !tooOld && !tooBusy {
+		return
+	}
+	reason := "unresponsive"
+	switch {
+	case !alive:
+	case tooOld:
+		reason = "max lifetime reached"
+	case tooBusy:
+		reason = "max requests reached"
+	}
+	fmt.Fprintf(errLog, "pool: retiring worker %d (%s)\n", idx, reason)
+	p.respawn(idx)
+}
+
+// respawn starts a replacement worker before tearing down the old one,
+// so Serve always has a worker to pick even mid-respawn.
+func (p *Pool) respawn(idx int) {
+	p.mu.Lock()
+	old := p.workers[idx]
+	p.mu.Unlock()
+
+	if old != nil {
+		atomic.StoreInt32(&old.draining, 1)
+	}
+
+	nw, err := p.spawn(idx)
+	if err != nil {
+		fmt.Fprintf(errLog, "pool: failed to respawn worker %d: %v\n", idx, err)
+		if old != nil {
+			atomic.StoreInt32(&old.draining, 0) // keep the old one rather than run with none
+		}
+		return
+	}
+
+	p.mu.Lock()
+	p.workers[idx] = nw
+	p.mu.Unlock()
+
+	if old != nil {
+		// Give in-flight requests a moment to finish against the old worker
+		// before it's killed outright.
+		time.AfterFunc(5*time.Second, func() {
+			if old.cmd.Process != nil {
+				old.cmd.Process.Kill()
+			}
+		})
+	}
+}
+
+type taggedWriter struct {
+	prefix string
+}
+
+func (t taggedWriter) Write(b []byte) (int, error) {
+	return fmt.Fprintf(errLog, "%s %s", t.prefix, b)
+}
@@ -0,0 +1,390 @@
+package main
+
+/*
+ * Process supervision for the three children runsm manages: Caddy, PHP and
+ * ebcfetch. Each gets a small admin.Process wrapper around its existing
+ * start/stop mechanics so the admin API (see the admin package) can report
+ * on and control them, instead of the old fire-and-forget cmd.Start().
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/ibauk/runsm/admin"
+	"github.com/ibauk/runsm/logging"
+)
+
+// ringLog is a small ring buffer of log lines that also fans new lines out
+// to any live admin log-stream subscribers, and into the rotating
+// structured log (see the logging package) tagged under component. It
+// implements io.Writer so it can sit directly in a cmd.Stdout/Stderr.
+type ringLog struct {
+	mu        sync.Mutex
+	max       int
+	component string
+	buf       []admin.Event
+	subs      map[chan admin.Event]struct{}
+	split     logging.LineSplitter
+}
+
+func newRingLog(max int, component string) *ringLog {
+	r := &ringLog{max: max, component: component, subs: make(map[chan admin.Event]struct{})}
+	r.split.OnLine = func(line string) {
+		smLogger.Capture(r.component, logging.LevelInfo, line)
+		r.append(admin.Event{Time: time.Now(), Line: line})
+	}
+	return r
+}
+
+func (r *ringLog) Write(p []byte) (int, error) {
+	return r.split.Write(p)
+}
+
+func (r *ringLog) append(ev admin.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, ev)
+	if len(r.buf) > r.max {
+		r.buf = r.buf[len(r.buf)-r.max:]
+	}
+	for ch := range r.subs {
+		select {
+		case ch <- ev:
+		default:
+			// a slow subscriber just misses lines rather than blocking the child
+		}
+	}
+}
+
+// subscribe returns a channel of future log lines. Callers must pass it to
+// unsubscribe once done watching, or the channel stays registered (and
+// append keeps iterating over it) forever.
+func (r *ringLog) subscribe() <-chan admin.Event {
+	ch := make(chan admin.Event, 64)
+	r.mu.Lock()
+	r.subs[ch] = struct{}{}
+	r.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes a channel returned by subscribe, so a disconnected
+// browser tab tailing a process's log doesn't leak a map entry that append
+// keeps fanning lines into for the rest of the run.
+func (r *ringLog) unsubscribe(ch <-chan admin.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.subs {
+		if c == ch {
+			delete(r.subs, c)
+			return
+		}
+	}
+}
+
+// caddyProc wraps runCaddy/killCaddy. Caddy's "start" subcommand daemonizes
+// the real server itself, so there's no long-lived *exec.Cmd to wait on -
+// Running is a best-effort check against the configured port instead.
+type caddyProc struct {
+	mu       sync.Mutex
+	ring     *ringLog
+	started  time.Time
+	restarts int
+	running  bool
+}
+
+func newCaddyProc() *caddyProc {
+	return &caddyProc{ring: newRingLog(500, "caddy")}
+}
+
+func (c *caddyProc) Name() string { return "caddy" }
+
+func (c *caddyProc) Start() error {
+	cancel, err := runCaddyLogged(c.ring)
+	if err != nil {
+		return fmt.Errorf("caddy: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel == nil {
+		return fmt.Errorf("caddy: did not start, see log")
+	}
+	if !c.started.IsZero() {
+		c.restarts++
+	}
+	c.started = time.Now()
+	c.running = true
+	return nil
+}
+
+func (c *caddyProc) Stop() error {
+	killCaddyLogged(c.ring)
+	c.mu.Lock()
+	c.running = false
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *caddyProc) Restart() error {
+	c.Stop()
+	return c.Start()
+}
+
+func (c *caddyProc) Wait() error { return nil } // nothing to wait on; see comment above
+
+func (c *caddyProc) State() admin.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return admin.State{
+		Name:     c.Name(),
+		Started:  c.started,
+		Restarts: c.restarts,
+		Running:  c.running && !rawPortAvail(*port),
+	}
+}
+
+func (c *caddyProc) Events() <-chan admin.Event { return c.ring.subscribe() }
+
+func (c *caddyProc) Unsubscribe(ch <-chan admin.Event) { c.ring.unsubscribe(ch) }
+
+// phpProc wraps the legacy respawn-on-a-timer PHP loop (runPHP/execPHP),
+// used when the worker pool (see the pool package) isn't enabled.
+type phpProc struct {
+	mu       sync.Mutex
+	ring     *ringLog
+	cmd      *exec.Cmd
+	pid      int
+	started  time.Time
+	restarts int
+	lastExit string
+	running  bool
+	stop     chan struct{}
+}
+
+func newPHPProc() *phpProc {
+	return &phpProc{ring: newRingLog(500, "php")}
+}
+
+func (p *phpProc) Name() string { return "php" }
+
+func (p *phpProc) Start() error {
+	p.mu.Lock()
+	if p.running {
+		p.mu.Unlock()
+		return nil
+	}
+	p.stop = make(chan struct{})
+	p.running = true
+	stop := p.stop
+	p.mu.Unlock()
+
+	go p.loop(stop)
+	return nil
+}
+
+// loop is runPHP's old "spawn, wait spawnInterval minutes, repeat" shape,
+// just with bookkeeping for the admin API folded in.
+func (p *phpProc) loop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		cmd := exec.Command(phpcgi, "-b", cgiport)
+		cmd.Env = append(os.Environ(), "PHP_FCGI_MAX_REQUESTS=0")
+		cmd.Stdout = p.ring
+		cmd.Stderr = p.ring
+
+		if err := cmd.Start(); err != nil {
+			p.mu.Lock()
+			p.lastExit = err.Error()
+			p.mu.Unlock()
+			fmt.Fprintf(p.ring, "PHP %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		p.mu.Lock()
+		p.cmd = cmd
+		p.pid = cmd.Process.Pid
+		if p.started.IsZero() {
+			p.restarts = 0
+		} else {
+			p.restarts++
+		}
+		p.started = time.Now()
+		p.mu.Unlock()
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		select {
+		case err := <-done:
+			p.mu.Lock()
+			if err != nil {
+				p.lastExit = err.Error()
+			} else {
+				p.lastExit = "exited"
+			}
+			p.mu.Unlock()
+		case <-time.After(time.Duration(*spawnInterval) * time.Minute):
+			cmd.Process.Kill()
+			<-done
+		case <-stop:
+			cmd.Process.Kill()
+			<-done
+			return
+		}
+	}
+}
+
+func (p *phpProc) Stop() error {
+	p.mu.Lock()
+	stop := p.stop
+	p.running = false
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	return nil
+}
+
+func (p *phpProc) Restart() error {
+	p.Stop()
+	return p.Start()
+}
+
+func (p *phpProc) Wait() error {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	return cmd.Wait()
+}
+
+func (p *phpProc) State() admin.State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return admin.State{
+		Name:     p.Name(),
+		Pid:      p.pid,
+		Started:  p.started,
+		Restarts: p.restarts,
+		Running:  p.running,
+		LastExit: p.lastExit,
+	}
+}
+
+func (p *phpProc) Events() <-chan admin.Event { return p.ring.subscribe() }
+
+func (p *phpProc) Unsubscribe(ch <-chan admin.Event) { p.ring.unsubscribe(ch) }
+
+// ebcProc wraps spawnEBCFetch, and stops ebcfetch by killing its process.
+// Output still reaches the console too, since ringLog hands every line to
+// the structured logger, whose console sink prints it whether or not
+// anybody's watching the admin log.
+type ebcProc struct {
+	mu       sync.Mutex
+	ring     *ringLog
+	cmd      *exec.Cmd
+	cancel   context.CancelFunc
+	pid      int
+	started  time.Time
+	restarts int
+	lastExit string
+	running  bool
+}
+
+func newEBCProc() *ebcProc {
+	return &ebcProc{ring: newRingLog(500, "ebcfetch")}
+}
+
+func (e *ebcProc) Name() string { return "ebcfetch" }
+
+func (e *ebcProc) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd, err := spawnEBCFetch(ctx, e.ring)
+	if err != nil {
+		cancel()
+		return err
+	}
+	e.mu.Lock()
+	e.cmd = cmd
+	e.cancel = cancel
+	e.pid = cmd.Process.Pid
+	if e.started.IsZero() {
+		e.restarts = 0
+	} else {
+		e.restarts++
+	}
+	e.started = time.Now()
+	e.running = true
+	e.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		e.mu.Lock()
+		e.running = false
+		if err != nil {
+			e.lastExit = err.Error()
+		} else {
+			e.lastExit = "exited"
+		}
+		e.mu.Unlock()
+	}()
+	return nil
+}
+
+func (e *ebcProc) Stop() error {
+	e.mu.Lock()
+	cmd := e.cmd
+	cancel := e.cancel
+	e.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+func (e *ebcProc) Restart() error {
+	e.Stop()
+	return e.Start()
+}
+
+func (e *ebcProc) Wait() error {
+	e.mu.Lock()
+	cmd := e.cmd
+	e.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	return cmd.Wait()
+}
+
+func (e *ebcProc) State() admin.State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return admin.State{
+		Name:     e.Name(),
+		Pid:      e.pid,
+		Started:  e.started,
+		Restarts: e.restarts,
+		Running:  e.running,
+		LastExit: e.lastExit,
+	}
+}
+
+func (e *ebcProc) Events() <-chan admin.Event { return e.ring.subscribe() }
+
+func (e *ebcProc) Unsubscribe(ch <-chan admin.Event) { e.ring.unsubscribe(ch) }
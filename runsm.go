@@ -35,6 +35,10 @@
  *	2022-07-01	-cdebug
  *	2022-07-16	Fixed IP specification handling
  *	2022-11-24	Enhanced error reporting
+ *	2026-07-26	Optional pooled PHP workers (-workers)
+ *	2026-07-26	Supervisor admin API (-admin)
+ *	2026-07-26	Reverse tunnel for remote scrutineering (-tunnel)
+ *	2026-07-26	Structured, rotating JSON logs (-log-format)
  *
  */
 
@@ -44,8 +48,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -56,6 +62,10 @@ import (
 	"time"
 	_ "time/tzdata"
 
+	"github.com/ibauk/runsm/admin"
+	"github.com/ibauk/runsm/logging"
+	"github.com/ibauk/runsm/pool"
+	"github.com/ibauk/runsm/tunnel"
 	"github.com/pkg/browser"
 )
 
@@ -74,23 +84,43 @@ var spawnInterval = flag.Int("respawn", 60, "Number of minutes before restarting
 var nolocal = flag.Bool("nolocal", false, "Don't start a web browser on the host machine")
 var ipWatch = flag.Bool("watch", false, "Monitor/report IP address changes")
 
+var workers = flag.Int("workers", 0, "Number of pre-forked PHP workers to pool, 0 disables the pool in favour of the single respawning php-cgi")
+var workerMaxRequests = flag.Int("worker-max-requests", 1000, "Requests a pooled PHP worker serves before it's retired")
+var workerMaxLifetime = flag.Int("worker-max-lifetime", 60, "Minutes a pooled PHP worker runs before it's retired")
+
+var admEnabled = flag.Bool("admin", false, "Run the supervisor admin API")
+var adminPort = flag.String("adminport", "9090", "Admin API port, bound to 127.0.0.1")
+
+var useTunnel = flag.Bool("tunnel", false, "Expose this server through a relay for remote scrutineering")
+var tunnelServer = flag.String("tunnelserver", "", "Relay server address, host:port")
+var tunnelToken = flag.String("tunneltoken", "", "Relay authentication token")
+var tunnelSubdomain = flag.String("subdomain", "", "Requested subdomain on the relay")
+
+var logFormat = flag.String("log-format", "text", "Console log format, text or json (the caddy/logs/ file is always json)")
+
 const cgiport = "127.0.0.1:9000"
 const smCaddyFolder = "caddy"
 const starturl = "http://localhost"
 
 var shuttingDown bool = false
 
-type logWriter struct {
-}
+var phpPool *pool.Pool
+
+var smLogger *logging.Logger
 
-func (writer logWriter) Write(bytes []byte) (int, error) {
-	return fmt.Print(time.Now().UTC().Format("2006-01-02 15:04:05") + " " + string(bytes))
+// legacyWriter adapts the structured logger to log.SetOutput, so the
+// existing scattered log.Print/log.Fatal calls all end up in the same
+// rotating JSON file as everything else, tagged as component "runsm".
+type legacyWriter struct{}
+
+func (legacyWriter) Write(b []byte) (int, error) {
+	smLogger.Info("runsm", strings.TrimRight(string(b), "\n"))
+	return len(b), nil
 }
 
 func init() {
 
 	log.SetFlags(0)
-	log.SetOutput(new(logWriter))
 
 	os := runtime.GOOS
 	switch os {
@@ -126,6 +156,13 @@ func main() {
 
 	setupRun()
 
+	var err error
+	smLogger, err = logging.New(filepath.Join(smCaddyFolder, "logs"), *logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(legacyWriter{})
+
 	if *ipWatch {
 		serverIP = getOutboundIP()
 		fmt.Printf("%s IPv4 = %s\n", timestamp(), serverIP)
@@ -133,12 +170,24 @@ func main() {
 
 	if *debug && phpdbg != "" {
 		debugPHP()
+	} else if *admEnabled {
+		startAdminSupervisor()
+	} else if *workers > 0 {
+		startPHPPool()
+		cancelCaddy = runCaddy()
 	} else {
 		cancelCaddy = runCaddy()
 		go runPHP()
 	}
 
-	cancelEBCFetch = runEBCFetch()
+	if !*admEnabled {
+		cancelEBCFetch = runEBCFetch()
+	}
+
+	var cancelTunnel context.CancelFunc
+	if *useTunnel && !*debug {
+		cancelTunnel = startTunnel()
+	}
 
 	if !*nolocal {
 		showInvite()
@@ -166,6 +215,18 @@ func main() {
 	}()
 	<-done
 	shuttingDown = true
+	if cancelTunnel != nil {
+		fmt.Printf("%s ending tunnel\n", timestamp())
+		cancelTunnel()
+	}
+	if phpPool != nil {
+		fmt.Printf("%s ending PHP worker pool\n", timestamp())
+		phpPool.Stop()
+	}
+	if *admEnabled {
+		fmt.Printf("%s ending supervised processes\n", timestamp())
+		stopAdminSupervisor()
+	}
 	if cancelCaddy != nil {
 		fmt.Printf("%s ending Caddy\n", timestamp())
 		killCaddy()
@@ -224,12 +285,120 @@ func execPHP() {
 	// This runs PHP as a background service to an external webserver
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*spawnInterval)*time.Minute)
 	defer cancel()
-	if err := exec.CommandContext(ctx, phpcgi, "-b", cgiport).Run(); err != nil {
+	cmd := exec.CommandContext(ctx, phpcgi, "-b", cgiport)
+	cmd.Stdout = smLogger.Writer("php", logging.LevelInfo)
+	cmd.Stderr = smLogger.Writer("php", logging.LevelWarn)
+	if err := cmd.Run(); err != nil {
 		//fmt.Println(phpcgi+" <=== ")
 		log.Printf("PHP %v\n", err)
 	}
 }
 
+// startPHPPool replaces execPHP/runPHP's single respawning php-cgi with a
+// pool of pre-forked workers, fronted by a small net/http server bound to
+// cgiport, which Caddy reverse proxies to as plain HTTP under -workers
+// (see runCaddyLogged) in place of its php_fastcgi directive.
+func startPHPPool() {
+
+	pool.SetErrorLog(smLogger.Writer("php", logging.LevelWarn))
+	phpPool = pool.NewPool(phpcgi, "sm", *workers, *workerMaxRequests, time.Duration(*workerMaxLifetime)*time.Minute)
+	if err := phpPool.Start(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s pooled %d PHP workers\n", timestamp(), *workers)
+
+	srv := &http.Server{
+		Addr:    cgiport,
+		Handler: http.HandlerFunc(phpPool.Serve),
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("PHP pool listener %v\n", err)
+		}
+	}()
+}
+
+var adminCaddy *caddyProc
+var adminPHP *phpProc
+var adminEBC *ebcProc
+
+// startAdminSupervisor starts caddy, PHP and ebcfetch behind the
+// admin.Process wrappers in process.go and serves the admin API over
+// them, so an operator can inspect/restart each one instead of only
+// finding out something died when scoring stops working.
+func startAdminSupervisor() {
+
+	var procs []admin.Process
+
+	adminCaddy = newCaddyProc()
+	if err := adminCaddy.Start(); err != nil {
+		log.Fatal(err)
+	}
+	procs = append(procs, adminCaddy)
+
+	if *workers > 0 {
+		// The pool (see the pool package) already supervises its own
+		// workers; it isn't wired into the admin API yet.
+		startPHPPool()
+	} else {
+		adminPHP = newPHPProc()
+		if err := adminPHP.Start(); err != nil {
+			log.Fatal(err)
+		}
+		procs = append(procs, adminPHP)
+	}
+
+	adminEBC = newEBCProc()
+	if err := adminEBC.Start(); err != nil {
+		log.Fatal(err)
+	}
+	procs = append(procs, adminEBC)
+
+	adminAddr := "127.0.0.1:" + *adminPort
+	srv := admin.NewServer(adminAddr, procs...)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			log.Printf("admin API %v\n", err)
+		}
+	}()
+	fmt.Printf("%s admin API on %s\n", timestamp(), adminAddr)
+}
+
+// startTunnel dials out to the configured relay so the webserver started
+// by runCaddy (or the admin supervisor) is reachable from outside the
+// local network, without opening anything inbound. Reconnects on its own
+// if the relay connection drops.
+func startTunnel() context.CancelFunc {
+	if *tunnelServer == "" {
+		log.Println("tunnel: -tunnelserver is required with -tunnel")
+		return nil
+	}
+
+	c := &tunnel.Client{
+		ServerAddr: *tunnelServer,
+		Token:      *tunnelToken,
+		Subdomain:  *tunnelSubdomain,
+		LocalAddr:  "127.0.0.1:" + *port,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Run(ctx)
+	fmt.Printf("%s tunnelling to %s\n", timestamp(), *tunnelServer)
+	return cancel
+}
+
+func stopAdminSupervisor() {
+	if adminCaddy != nil {
+		adminCaddy.Stop()
+	}
+	if adminPHP != nil {
+		adminPHP.Stop()
+	}
+	if adminEBC != nil {
+		adminEBC.Stop()
+	}
+}
+
 func getOutboundIP() net.IP {
 	udp := "udp"
 	ip := "8.8.8.8:80" // Google public DNS
@@ -274,12 +443,27 @@ func runPHP() {
 }
 
 func runCaddy() context.CancelFunc {
+	cancel, err := runCaddyLogged(smLogger.Writer("caddy", logging.LevelWarn))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cancel
+}
+
+// runCaddyLogged is runCaddy with the "caddy start" command's own
+// stdout/stderr captured to w, so the admin API (see caddyProc in
+// process.go) has something to show for the caddy process. It reports
+// failures by returning an error rather than calling log.Fatal itself:
+// runCaddy (the startup path) still treats that as fatal, but caddyProc
+// (the admin-supervised path) needs to survive a failed restart without
+// taking the rest of runsm down with it.
+func runCaddyLogged(w io.Writer) (context.CancelFunc, error) {
 
 	// If IP is not wildcard then assume that grownup has checked
 	if *ipspec == "*" {
 		if !rawPortAvail(*port) {
 			fmt.Println(timestamp() + " service port " + *port + " already served")
-			return nil
+			return nil, nil
 		}
 		if !testWebPort(*port) {
 			if *port != *alternateWebPort && testWebPort(*alternateWebPort) {
@@ -296,7 +480,7 @@ func runCaddy() context.CancelFunc {
 	ep := filepath.Join(smCaddyFolder, "error.log")
 	f, err := os.Create(cp)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	f.WriteString("{\nhttp_port " + *port + "\n")
 	if *cdebug {
@@ -307,7 +491,20 @@ func runCaddy() context.CancelFunc {
 	f.WriteString(*ipspec + ":" + *port + "\n")
 	f.WriteString("file_server\n")
 	f.WriteString("root sm\n")
-	f.WriteString("php_fastcgi " + cgiport + "\n")
+	if *workers > 0 {
+		// The pool's worker(s) are fronted by our own net/http listener on
+		// cgiport, so Caddy reverse proxies plain HTTP rather than speaking
+		// FastCGI itself - but unlike php_fastcgi, a plain reverse_proxy has
+		// no idea which requests are PHP, so it must only be handed requests
+		// that resolve to an actual .php file; everything else (css/js/
+		// images under sm/) stays with file_server above.
+		f.WriteString("@phpfiles {\n\tfile {\n\t\ttry_files {path} {path}/index.php\n\t}\n}\n")
+		f.WriteString("rewrite @phpfiles {http.matchers.file.relative}\n")
+		f.WriteString("@phpscripts path *.php */\n")
+		f.WriteString("reverse_proxy @phpscripts " + cgiport + "\n")
+	} else {
+		f.WriteString("php_fastcgi " + cgiport + "\n")
+	}
 	f.Close()
 
 	// Now run Caddy
@@ -315,43 +512,80 @@ func runCaddy() context.CancelFunc {
 	//defer cancel()
 	fp := filepath.Join(smCaddyFolder, "caddy")
 
-	if err := exec.CommandContext(ctx, fp, "start", "--config", cp, "--adapter", "caddyfile").Run(); err != nil {
+	cmd := exec.CommandContext(ctx, fp, "start", "--config", cp, "--adapter", "caddyfile")
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
 		log.Println(("Unable to launch Caddy, is it already running?"))
-		log.Fatal(err)
+		cancel()
+		return nil, err
 	}
-	return cancel
+	return cancel, nil
 
 }
 
 func runEBCFetch() context.CancelFunc {
 
 	ctx, cancel := context.WithCancel(context.TODO())
+	if _, err := spawnEBCFetch(ctx, smLogger.Writer("ebcfetch", logging.LevelInfo)); err != nil {
+		log.Fatal(err)
+	}
+	return cancel
+
+}
+
+// spawnEBCFetch starts the ebcfetch binary with its output captured to w
+// (an admin log-stream subscriber, see ebcProc in process.go, gets the
+// same lines) instead of the old direct-to-console os.Stdout/os.Stderr.
+func spawnEBCFetch(ctx context.Context, w io.Writer) (*exec.Cmd, error) {
+
 	fp := filepath.Join(smCaddyFolder, "ebcfetch")
 
 	fmt.Printf("%s spawning %s\n", timestamp(), fp)
 
 	cmd := exec.CommandContext(ctx, fp)
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = w
+	cmd.Stderr = w
 	if err := cmd.Start(); err != nil {
 		fmt.Printf("%s %s unspawned %v \n", timestamp(), fp, err)
-
-		log.Fatal(err)
+		return nil, err
 	}
 	fmt.Printf("%s %s spawned\n", timestamp(), fp)
-	return cancel
+	return cmd, nil
 
 }
 
 func killCaddy() {
+	killCaddyLogged(smLogger.Writer("caddy", logging.LevelWarn))
+}
+
+// killCaddyLogged runs "caddy stop" to completion and then waits for *port
+// to actually come free, rather than firing the stop command and
+// returning immediately - a caller that turns around and calls
+// runCaddyLogged straight after (caddyProc.Restart, via the admin API)
+// would otherwise very likely collide with the still-shutting-down old
+// instance on *port.
+func killCaddyLogged(w io.Writer) {
 
 	fp := filepath.Join(smCaddyFolder, "caddy")
 	cmd := exec.Command(fp, "stop")
-	cmd.Start()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	cmd.Run()
+	waitPortReleased(*port, 10*time.Second)
 
 }
 
+// waitPortReleased polls rawPortAvail until port frees up or timeout
+// elapses, whichever comes first.
+func waitPortReleased(port string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for !rawPortAvail(port) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func killEBCFetch() {
 
 }
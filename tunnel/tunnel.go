@@ -0,0 +1,135 @@
+// Package tunnel lets a ScoreMaster instance sitting behind a hotel NAT be
+// reached from elsewhere, by dialing out to a relay server instead of
+// having anything dial in. It follows the same control/work-connection
+// split as frp: one long-lived control connection carries login and
+// NewWorkConn messages, and each NewWorkConn is answered by opening a
+// fresh connection to the relay that gets joined to the local webserver.
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Client is a tunnel endpoint: it logs in to ServerAddr with Token and
+// asks for Subdomain, then proxies every work connection the relay opens
+// through to the given local port.
+type Client struct {
+	ServerAddr string // relay's control port, host:port
+	Token      string
+	Subdomain  string
+	LocalAddr  string // local address to forward to, e.g. "127.0.0.1:80"
+}
+
+// message is the control-connection wire format: newline-delimited JSON,
+// which is all this needs given the handful of message types below.
+type message struct {
+	Type      string `json:"type"`
+	Token     string `json:"token,omitempty"`
+	Subdomain string `json:"subdomain,omitempty"`
+	PublicURL string `json:"publicUrl,omitempty"`
+	WorkID    string `json:"workId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+const reconnectDelay = 5 * time.Second
+
+// Run dials the relay and serves work connections until ctx is cancelled,
+// reconnecting on any control-connection drop.
+func (c *Client) Run(ctx context.Context) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := c.connectOnce(ctx); err != nil {
+			log.Printf("tunnel: %v, reconnecting in %s\n", err, reconnectDelay)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (c *Client) connectOnce(ctx context.Context) error {
+	// The control connection carries Token in plaintext JSON and the relay
+	// sits on a public/untrusted network path, so it's TLS, with the
+	// relay's certificate verified against the system roots, the same as
+	// any other internet-facing client of ours.
+	conn, err := tls.Dial("tcp", c.ServerAddr, &tls.Config{})
+	if err != nil {
+		return fmt.Errorf("dialing relay: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(bufio.NewReader(conn))
+
+	if err := enc.Encode(message{Type: "login", Token: c.Token, Subdomain: c.Subdomain}); err != nil {
+		return fmt.Errorf("sending login: %w", err)
+	}
+
+	var resp message
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("reading login response: %w", err)
+	}
+	if resp.Type != "loginOk" {
+		return fmt.Errorf("relay rejected login: %s", resp.Reason)
+	}
+	fmt.Printf("tunnel: public URL %s\n", resp.PublicURL)
+
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("control connection: %w", err)
+		}
+		if msg.Type != "newWorkConn" {
+			continue
+		}
+		go c.serveWorkConn(msg.WorkID)
+	}
+}
+
+// serveWorkConn opens a fresh connection to the relay, identifies it
+// against the control connection's WorkID, and joins it to the local
+// webserver until either side closes.
+func (c *Client) serveWorkConn(workID string) {
+	// Proxied traffic (scored uploads) gets the same TLS treatment as the
+	// control connection rather than riding over it in the clear.
+	relay, err := tls.Dial("tcp", c.ServerAddr, &tls.Config{})
+	if err != nil {
+		log.Printf("tunnel: work connection to relay: %v\n", err)
+		return
+	}
+	defer relay.Close()
+
+	if err := json.NewEncoder(relay).Encode(message{Type: "workConn", WorkID: workID}); err != nil {
+		log.Printf("tunnel: identifying work connection: %v\n", err)
+		return
+	}
+
+	local, err := net.Dial("tcp", c.LocalAddr)
+	if err != nil {
+		log.Printf("tunnel: dialing local server: %v\n", err)
+		return
+	}
+	defer local.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(relay, local); done <- struct{}{} }()
+	go func() { io.Copy(local, relay); done <- struct{}{} }()
+	<-done
+}